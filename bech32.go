@@ -1,10 +1,13 @@
-// Package bech32 implements BIP173.
+// Package bech32 implements BIP173, plus the Bech32m variant from BIP350.
 package bech32
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"math/bits"
+	"strconv"
 	"strings"
 )
 
@@ -55,94 +58,213 @@ var (
 	errDataChar  = errors.New("bech32: illegal character in data part")
 )
 
-// Parse decodes a Bech32 string, with label for the human-readable part/prefix.
-// Padding has the number of zero bits added to the last data byte, in the range
-// of 0 to 7.
+// ConvertBits errors.
+var (
+	errConvertBitsRange = errors.New("bech32: fromBits and toBits must each be between 1 and 8")
+	errConvertBitsValue = errors.New("bech32: data value exceeds fromBits width")
+	errConvertBitsPad   = errors.New("bech32: data does not convert to a whole number of toBits groups")
+)
+
+// Encoding distinguishes the original Bech32 checksum constant from Bech32m,
+// the variant BIP350 introduced to fix Bech32's error-detection weakness for
+// inputs that differ only in a run of trailing 'q' characters.
+type Encoding int
+
+// Encoding values.
+const (
+	Bech32 Encoding = iota
+	Bech32m
+)
+
+// String implements the fmt.Stringer interface.
+func (e Encoding) String() string {
+	switch e {
+	case Bech32:
+		return "bech32"
+	case Bech32m:
+		return "bech32m"
+	default:
+		return "bech32.Encoding(" + strconv.Itoa(int(e)) + ")"
+	}
+}
+
+// These are the values check5Bits settles on for a valid serial, XORed into
+// the checksum on Format. BIP173 fixes it to bech32Const; BIP350 introduced
+// bech32mConst for Bech32m.
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+// Parse decodes a Bech32 string, with label for the human-readable
+// part/prefix. Padding has the number of zero bits added to the last data
+// byte, in the range of 0 to 7. A Bech32m serial is rejected with
+// ChecksumError(0); use Parse2 to accept either variant.
 func Parse(s string) (label string, payload []byte, padding int, err error) {
+	label, symbols, code, dataStart, checksumStart, err := decode(s)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	return resolve(s, label, symbols, code, bech32Const, dataStart, checksumStart)
+}
+
+// ParseM decodes a Bech32m string, with label for the human-readable
+// part/prefix. Padding has the number of zero bits added to the last data
+// byte, in the range of 0 to 7. A Bech32 serial is rejected with
+// ChecksumError(0); use Parse2 to accept either variant.
+func ParseM(s string) (label string, payload []byte, padding int, err error) {
+	label, symbols, code, dataStart, checksumStart, err := decode(s)
+	if err != nil {
+		return "", nil, 0, err
+	}
+	return resolve(s, label, symbols, code, bech32mConst, dataStart, checksumStart)
+}
+
+// Parse2 decodes either a Bech32 or a Bech32m string, with label for the
+// human-readable part/prefix, and enc reporting which of the two checksum
+// constants matched. Padding has the number of zero bits added to the last
+// data byte, in the range of 0 to 7.
+func Parse2(s string) (label string, payload []byte, padding int, enc Encoding, err error) {
+	label, symbols, code, dataStart, checksumStart, err := decode(s)
+	if err != nil {
+		return "", nil, 0, 0, err
+	}
+
+	switch code {
+	case bech32Const:
+		payload, padding = unpackSymbols(symbols[:checksumStart-dataStart])
+		return label, payload, padding, Bech32, nil
+	case bech32mConst:
+		payload, padding = unpackSymbols(symbols[:checksumStart-dataStart])
+		return label, payload, padding, Bech32m, nil
+	}
+
+	for _, enc := range [...]Encoding{Bech32, Bech32m} {
+		constant := uint(bech32Const)
+		if enc == Bech32m {
+			constant = bech32mConst
+		}
+		if fixed, bitN, ok := bchRecover(s, dataStart, code, constant); ok {
+			payload, padding = unpackSymbols(fixed[:checksumStart-dataStart])
+			return label, payload, padding, enc, ChecksumError(bitN)
+		}
+	}
+	return "", nil, 0, 0, ChecksumError(0)
+}
+
+// resolve applies the error-correction and ChecksumError reporting shared by
+// Parse and ParseM once decode has produced a checksum residue for constant
+// to be compared against, and regroups the data-part symbols (i.e. symbols
+// with the trailing checksum trimmed off) into payload bytes.
+func resolve(s, label string, symbols []byte, code, constant uint, dataStart, checksumStart int) (string, []byte, int, error) {
+	if code == constant {
+		payload, padding := unpackSymbols(symbols[:checksumStart-dataStart])
+		return label, payload, padding, nil
+	}
+	if fixed, bitN, ok := bchRecover(s, dataStart, code, constant); ok {
+		payload, padding := unpackSymbols(fixed[:checksumStart-dataStart])
+		return label, payload, padding, ChecksumError(bitN)
+	}
+	return "", nil, 0, ChecksumError(0)
+}
+
+// decode reads the label and the 5-bit data-part values (including the 6
+// trailing checksum symbols) from a Bech32(m) serial, and returns the
+// checksum residue code for the caller to compare against whichever of
+// bech32Const or bech32mConst applies. dataStart and checksumStart are byte
+// offsets into s, needed for error correction on a checksum mismatch.
+func decode(s string) (label string, symbols []byte, code uint, dataStart, checksumStart int, err error) {
 	if len(s) > 90 {
-		return "", nil, 0, ErrBig
+		return "", nil, 0, 0, 0, ErrBig
 	}
 
 	if lower := strings.ToLower(s); lower != s {
 		if strings.ToUpper(s) != s {
-			return "", nil, 0, errCaseMix
+			return "", nil, 0, 0, 0, errCaseMix
 		}
 		s = lower // continue with lowercase
 	}
 
 	i := strings.LastIndexByte(s, '1')
 	if i <= 0 {
-		return "", nil, 0, errNoLabel
+		return "", nil, 0, 0, 0, errNoLabel
 	} else if len(s)-i < 7 {
-		return "", nil, 0, errNoCksum
+		return "", nil, 0, 0, 0, errNoCksum
 	}
 
 	label = s[:i]
-	code, err := labelCheck(label)
+	code, err = labelCheck(label)
 	if err != nil {
-		return "", nil, 0, err
+		return "", nil, 0, 0, 0, err
 	}
 
 	i++ // data part offset
-	checksumStart := len(s) - 6
-	payload = make([]byte, ((((checksumStart - i) * 5) + 7) / 8))
-	var o int // write index for payload
-
-	var acc uint64 // accumulate buffer
-	var accN uint  // accumulute count
-	for ; i < checksumStart; i++ {
-		v := charTable[s[i]]
+	dataStart = i
+	checksumStart = len(s) - 6
+
+	symbols = make([]byte, len(s)-i)
+	for k := range symbols {
+		v := charTable[s[i+k]]
 		if v > 31 {
-			return "", nil, 0, errDataChar
+			return "", nil, 0, 0, 0, errDataChar
 		}
-
+		symbols[k] = v
 		code = check5Bits(code, uint(v))
+	}
 
-		acc = acc<<5 | uint64(v)
-		accN += 5
-		if accN == 40 {
-			payload[o+0] = byte(acc >> 32)
-			payload[o+1] = byte(acc >> 24)
-			payload[o+2] = byte(acc >> 16)
-			payload[o+3] = byte(acc >> 8)
-			payload[o+4] = byte(acc >> 0)
-			o += 5
+	return label, symbols, code, dataStart, checksumStart, nil
+}
 
-			accN = 0 // clear
-		}
-	}
-	// flush remaining bits
-	for ; accN > 7; accN -= 8 {
-		payload[o] = byte(acc >> (accN - 8))
-		o++
-	}
-	if accN != 0 {
-		padding = int(8 - accN)
-		payload[o] = byte(acc << uint(padding))
-	}
+// Unlimited disables the 90-character serial length ceiling BIP173 defines,
+// for use with Formatter on protocols that raise or remove it.
+const Unlimited = -1
 
-	// checksum
-	for ; i < len(s); i++ {
-		v := charTable[s[i]]
-		if v > 31 {
-			return "", nil, 0, errDataChar
-		}
-		code = check5Bits(code, uint(v))
-	}
-	if code != 1 {
-		// BUG(pascaldekloe): Error recovery not implemented yet.
-		// All data corruption leads to ChecksumError zero.
-		return "", nil, 0, ChecksumError(0)
-	}
+// Formatter generates Bech32(m) serials with a configurable length ceiling.
+// The zero value applies the 90-character ceiling from BIP173. Set MaxLen to
+// Unlimited to disable it, or to another positive value to apply a
+// protocol-specific ceiling instead.
+type Formatter struct {
+	MaxLen int
+}
 
-	return label, payload, padding, nil
+func (f Formatter) maxLen() int {
+	if f.MaxLen == 0 {
+		return 90
+	}
+	return f.MaxLen
 }
 
-// Parse encodes a Bech32 string, with label for the human-readable part/prefix.
-// A total of bitN bits are read from p in big endian (bit and byte) order. The
-// result may contain up to four additional data bits, as it encodes in chunks
-// of 5 bits. The padding bits are all zero.
+// Format encodes a Bech32 string, with label for the human-readable
+// part/prefix. A total of bitN bits are read from p in big endian (bit and
+// byte) order. The result may contain up to four additional data bits, as it
+// encodes in chunks of 5 bits. The padding bits are all zero.
 func Format(label string, p []byte, bitN int) (string, error) {
+	return Formatter{}.Format(label, p, bitN)
+}
+
+// FormatM encodes a Bech32m string, with label for the human-readable
+// part/prefix. A total of bitN bits are read from p in big endian (bit and
+// byte) order. The result may contain up to four additional data bits, as it
+// encodes in chunks of 5 bits. The padding bits are all zero.
+func FormatM(label string, p []byte, bitN int) (string, error) {
+	return Formatter{}.FormatM(label, p, bitN)
+}
+
+// Format encodes a Bech32 string the same way the package-level Format does,
+// except the serial length is capped by f.MaxLen instead of BIP173's fixed
+// 90 characters.
+func (f Formatter) Format(label string, p []byte, bitN int) (string, error) {
+	return format(label, p, bitN, bech32Const, f.maxLen())
+}
+
+// FormatM encodes a Bech32m string the same way the package-level FormatM
+// does, except the serial length is capped by f.MaxLen instead of BIP173's
+// fixed 90 characters.
+func (f Formatter) FormatM(label string, p []byte, bitN int) (string, error) {
+	return format(label, p, bitN, bech32mConst, f.maxLen())
+}
+
+func format(label string, p []byte, bitN int, constant uint, maxLen int) (string, error) {
 	if bitN < 0 {
 		bitN = 0
 	}
@@ -150,64 +272,351 @@ func Format(label string, p []byte, bitN int) (string, error) {
 		return "", io.ErrShortBuffer
 	}
 
-	// label + '1' seperator + payload base32 + checksum base64
-	l := 7 + len(label) + (bitN+4)/5
-	if l > 90 {
-		return "", ErrBig
+	// Format's bitN need not be a multiple of 8, so p is unpacked one bit at
+	// a time rather than over whole bytes before regrouping into symbols.
+	bitString := make([]byte, bitN)
+	for i := range bitString {
+		bitString[i] = p[i/8] >> uint(7-i%8) & 1
+	}
+	symbols, _ := ConvertBits(bitString, 1, 5, true) // bits are always < 2, so err is impossible
+
+	return formatSymbols(label, symbols, constant, maxLen)
+}
+
+// ConvertBits regroups data, a slice of values each holding fromBits
+// significant bits, into a slice of values holding toBits significant bits
+// instead, most-significant bit first. With pad true, a final group short of
+// toBits is zero-padded to make a whole one; with pad false, ConvertBits
+// instead requires the input to produce whole groups exactly, rejecting it
+// if the bits that would otherwise be dropped are not all zero. This is the
+// regrouping Format/Parse apply between bytes and 5-bit symbols (fromBits,
+// toBits of 8 and 5, or the reverse), exported so that callers such as
+// FormatSymbols/ParseSymbols, or a SegWit/BOLT-11 layer on top of them, don't
+// have to reimplement it.
+func ConvertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	if fromBits == 0 || fromBits > 8 || toBits == 0 || toBits > 8 {
+		return nil, errConvertBitsRange
 	}
-	var b strings.Builder
-	b.Grow(l)
-	b.WriteString(label)
-	b.WriteByte('1')
+
+	out := make([]byte, 0, (len(data)*int(fromBits)+int(toBits)-1)/int(toBits))
+	maxOut := uint32(1)<<toBits - 1
+	maxAcc := uint32(1)<<(fromBits+toBits-1) - 1
+
+	var acc uint32
+	var accN uint
+	for _, v := range data {
+		if uint32(v)>>fromBits != 0 {
+			return nil, errConvertBitsValue
+		}
+		acc = (acc<<fromBits | uint32(v)) & maxAcc
+		accN += fromBits
+		for accN >= toBits {
+			accN -= toBits
+			out = append(out, byte(acc>>accN&maxOut))
+		}
+	}
+
+	if pad {
+		if accN > 0 {
+			out = append(out, byte(acc<<(toBits-accN)&maxOut))
+		}
+	} else if accN >= fromBits || acc<<(toBits-accN)&maxOut != 0 {
+		return nil, errConvertBitsPad
+	}
+	return out, nil
+}
+
+// FormatSymbols encodes a Bech32 string directly from 5-bit values, each in
+// the range 0 to 31, appending the checksum itself. Combined with
+// ConvertBits, this is what Format uses under the hood for callers that want
+// access to the data part before it settles on byte alignment.
+func FormatSymbols(label string, symbols []byte) (string, error) {
+	return Formatter{}.FormatSymbols(label, symbols)
+}
+
+// FormatSymbols is the Formatter equivalent of the package-level
+// FormatSymbols, with the serial length capped by f.MaxLen.
+func (f Formatter) FormatSymbols(label string, symbols []byte) (string, error) {
+	return formatSymbols(label, symbols, bech32Const, f.maxLen())
+}
+
+// ParseSymbols reads the label and the 5-bit data-part values (the payload
+// excluding the 6-character checksum) from a Bech32 string s. Combined with
+// ConvertBits, this is what Parse uses under the hood for callers that want
+// the data part before it is regrouped into bytes. A Bech32m serial is
+// rejected with ChecksumError(0), same as Parse; a positive ChecksumError is
+// a recovered-checksum warning carrying the corrected symbols, not a
+// failure, same as Parse.
+func ParseSymbols(s string) (label string, symbols []byte, err error) {
+	label, all, code, dataStart, checksumStart, err := decode(s)
+	if err != nil {
+		return "", nil, err
+	}
+	if code == bech32Const {
+		return label, all[:checksumStart-dataStart], nil
+	}
+	if fixed, bitN, ok := bchRecover(s, dataStart, code, bech32Const); ok {
+		return label, fixed[:checksumStart-dataStart], ChecksumError(bitN)
+	}
+	return "", nil, ChecksumError(0)
+}
+
+// errEncoderClosed is returned by Write once Close has run.
+var errEncoderClosed = errors.New("bech32: write to closed encoder")
+
+// NewEncoder returns a streaming Bech32 encoder, with label for the
+// human-readable part/prefix. Bytes written to the result are consumed in
+// big endian (bit and byte) order, five bits at a time, the same way Format
+// reads p. Close must be called once writing is complete: it flushes any
+// pending data bits (zero-padded, same as Format) and appends the checksum.
+// The label and the 90-character BIP173 ceiling are applied as soon as
+// NewEncoder is called, before any byte reaches w.
+func NewEncoder(label string, w io.Writer) io.WriteCloser {
+	return Formatter{}.NewEncoder(label, w)
+}
+
+// NewEncoderM is the Bech32m equivalent of NewEncoder.
+func NewEncoderM(label string, w io.Writer) io.WriteCloser {
+	return Formatter{}.NewEncoderM(label, w)
+}
+
+// NewEncoder returns a streaming Bech32 encoder the same way the
+// package-level NewEncoder does, except the serial length is capped by
+// f.MaxLen instead of BIP173's fixed 90 characters.
+func (f Formatter) NewEncoder(label string, w io.Writer) io.WriteCloser {
+	return newEncoder(label, w, bech32Const, f.maxLen())
+}
+
+// NewEncoderM is the Bech32m equivalent of Formatter.NewEncoder.
+func (f Formatter) NewEncoderM(label string, w io.Writer) io.WriteCloser {
+	return newEncoder(label, w, bech32mConst, f.maxLen())
+}
+
+// encoder is the io.WriteCloser returned by NewEncoder. The checksum is a
+// running BCH residue rather than a pass over a buffered serial, so Write
+// never needs to hold more than the label, the checksum state and up to 4
+// pending data bits.
+type encoder struct {
+	w        io.Writer
+	code     uint
+	constant uint
+	maxLen   int
+	n        int // characters written to w so far
+	acc      uint
+	accN     uint
+	err      error
+	closed   bool
+}
+
+func newEncoder(label string, w io.Writer, constant uint, maxLen int) *encoder {
+	e := &encoder{w: w, constant: constant, maxLen: maxLen}
 
 	code, err := labelCheck(label)
 	if err != nil {
-		return "", err
+		e.err = err
+		return e
+	}
+	// label + '1' separator + 0 data symbols + 6 checksum symbols
+	if maxLen != Unlimited && 7+len(label) > maxLen {
+		e.err = ErrBig
+		return e
+	}
+	if _, err := io.WriteString(w, label); err != nil {
+		e.err = err
+		return e
+	}
+	if _, err := w.Write([]byte{'1'}); err != nil {
+		e.err = err
+		return e
+	}
+	e.code = code
+	e.n = len(label) + 1
+	return e
+}
+
+// writeSymbol emits the base32 character for the 5-bit value v, folding it
+// into the running checksum, once room for the still-to-come 6-character
+// checksum has been confirmed.
+func (e *encoder) writeSymbol(v uint) error {
+	if e.maxLen != Unlimited && e.n+7 > e.maxLen {
+		e.err = ErrBig
+		return e.err
 	}
+	e.code = check5Bits(e.code, v)
+	if _, err := e.w.Write([]byte{dictionary[v]}); err != nil {
+		e.err = err
+		return err
+	}
+	e.n++
+	return nil
+}
 
-	var acc uint  // accumulate buffer
-	var accN uint // accumulute count
-	pendingN := uint(bitN)
+// Write implements the io.Writer interface.
+func (e *encoder) Write(p []byte) (n int, err error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	if e.closed {
+		return 0, errEncoderClosed
+	}
 	for _, c := range p {
-		acc = acc<<8 | uint(c)
-		if pendingN < 5 {
-			accN += 8
-			break
-		}
-		accN += 3
-		if pendingN > 9 && accN > 4 {
-			// do two base32 characters
-			v := acc >> accN & 31
-			accN -= 5
-			code = check5Bits(code, v)
-			b.WriteByte(dictionary[v])
-			pendingN -= 5
-		}
-		v := acc >> accN & 31
-		code = check5Bits(code, v)
-		b.WriteByte(dictionary[v])
-		pendingN -= 5
+		e.acc = e.acc<<8 | uint(c)
+		e.accN += 8
+		for e.accN >= 5 {
+			e.accN -= 5
+			if err := e.writeSymbol(e.acc >> e.accN & 31); err != nil {
+				return n, err
+			}
+		}
+		n++
 	}
-	if pendingN != 0 {
-		acc >>= accN - pendingN
-		acc <<= 5 - pendingN
-		code = check5Bits(code, acc)
-		b.WriteByte(dictionary[acc])
+	return n, nil
+}
+
+// Close flushes any pending data bits and appends the checksum. It is safe
+// to call more than once; only the first call writes to w.
+func (e *encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.closed {
+		return nil
+	}
+	e.closed = true
+
+	if e.accN != 0 {
+		v := e.acc << (5 - e.accN) & 31
+		if err := e.writeSymbol(v); err != nil {
+			return err
+		}
 	}
 
-	// checksum
+	code := e.code
 	for i := 0; i < 6; i++ {
 		code = check5Bits(code, 0)
 	}
-	code ^= 1
-	b.WriteByte(dictionary[code>>25&31])
-	b.WriteByte(dictionary[code>>20&31])
-	b.WriteByte(dictionary[code>>15&31])
-	b.WriteByte(dictionary[code>>10&31])
-	b.WriteByte(dictionary[code>>5&31])
-	b.WriteByte(dictionary[code>>0&31])
+	code ^= e.constant
+	sum := [6]byte{
+		dictionary[code>>25&31],
+		dictionary[code>>20&31],
+		dictionary[code>>15&31],
+		dictionary[code>>10&31],
+		dictionary[code>>5&31],
+		dictionary[code>>0&31],
+	}
+	if _, err := e.w.Write(sum[:]); err != nil {
+		e.err = err
+		return err
+	}
+	return nil
+}
 
-	return b.String(), nil
+// NewDecoder reads a Bech32 serial from r, with label for the human-readable
+// part/prefix and padding for the number of zero bits in the last payload
+// byte, same as Parse. Unlike NewEncoder, decoding cannot proceed symbol by
+// symbol: the label may itself contain '1' characters, so the split between
+// label and data, and in turn the position of the 6-character checksum, is
+// only known once r is exhausted. NewDecoder therefore reads r in full
+// before it returns, though it aborts as soon as the 90-character BIP173
+// ceiling is exceeded rather than buffering an unbounded stream. Checksum
+// verification stays deferred regardless: NewDecoder itself only reports a
+// malformed label, character set or length, while a checksum mismatch (or
+// its BCH recovery) surfaces as the error from rc's final Read, or from
+// Close, once the payload has been delivered in full. A Bech32m serial is
+// rejected the same way, with ChecksumError(0); a positive ChecksumError is
+// a recovered-checksum warning, not a failure, and rc still delivers the
+// corrected payload ahead of it.
+func NewDecoder(r io.Reader) (label string, padding int, rc io.ReadCloser, err error) {
+	s, err := readSerial(r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	label, symbols, code, dataStart, checksumStart, err := decode(s)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	if rem := (checksumStart - dataStart) * 5 % 8; rem != 0 {
+		padding = 8 - rem
+	}
+	return label, padding, &decoder{s: s, symbols: symbols, code: code, dataStart: dataStart, checksumStart: checksumStart}, nil
+}
+
+// readSerial reads r to completion, the same way NewDecoder must before the
+// label/data split can be determined, except it aborts with ErrBig as soon
+// as the 90-character ceiling is exceeded instead of buffering an unbounded
+// stream in full first.
+func readSerial(r io.Reader) (string, error) {
+	var buf bytes.Buffer
+	chunk := make([]byte, 512)
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			buf.Write(chunk[:n])
+			if buf.Len() > 90 {
+				return "", ErrBig
+			}
+		}
+		switch err {
+		case nil:
+		case io.EOF:
+			return buf.String(), nil
+		default:
+			return "", err
+		}
+	}
+}
+
+// decoder is the io.ReadCloser returned by NewDecoder. Error correction
+// needs the symbols from the whole serial rather than a prefix of them, so
+// the payload is resolved once, on the first Read or Close, instead of
+// symbol by symbol the way the encoder from NewEncoder writes them; from there
+// on, bytes are served out of the resolved payload, and the deferred
+// checksum result surfaces once it runs dry.
+type decoder struct {
+	s             string
+	symbols       []byte
+	code          uint
+	dataStart     int
+	checksumStart int
+
+	resolved bool
+	payload  []byte
+	err      error
+	pos      int
+}
+
+func (d *decoder) resolve() {
+	if d.resolved {
+		return
+	}
+	d.resolved = true
+	_, d.payload, _, d.err = resolve(d.s, "", d.symbols, d.code, bech32Const, d.dataStart, d.checksumStart)
+}
+
+// Read implements the io.Reader interface. The deferred ChecksumError (or
+// io.EOF on a clean match) surfaces only once the payload has been
+// delivered in full.
+func (d *decoder) Read(p []byte) (int, error) {
+	d.resolve()
+	if d.pos >= len(d.payload) {
+		if d.err != nil {
+			return 0, d.err
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, d.payload[d.pos:])
+	d.pos += n
+	return n, nil
+}
+
+// Close resolves the payload if Read never ran to completion, and reports
+// the same deferred checksum result Read would have. It is safe to call
+// more than once.
+func (d *decoder) Close() error {
+	d.resolve()
+	return d.err
 }
 
 // LabelCheck validates the label and returns the checksum.
@@ -228,6 +637,258 @@ func labelCheck(label string) (uint, error) {
 	return code, nil
 }
 
+// unpackSymbols regroups 5-bit values into 8-bit bytes via ConvertBits,
+// reporting padding, the number of zero bits appended to the last byte, the
+// same way Parse does. It is used to redecode the data part once bchRecover
+// has corrected its symbols, or once the checksum matched outright. Symbol
+// values are always below 32, so the ConvertBits error is impossible here.
+func unpackSymbols(symbols []byte) (payload []byte, padding int) {
+	payload, _ = ConvertBits(symbols, 5, 8, true)
+	if rem := len(symbols) * 5 % 8; rem != 0 {
+		padding = 8 - rem
+	}
+	return payload, padding
+}
+
+// symbolFix is a single 5-bit symbol correction: the value at pos needs to be
+// XOR'ed with delta to recover the original.
+type symbolFix struct {
+	pos   int
+	delta byte
+}
+
+// bchRecover attempts BCH(32, k) error correction on the data and checksum
+// symbols of s, which start at index dataStart and run to the end of s. code
+// is the checksum residue Parse computed over the (uncorrected) input, and
+// target is the constant (bech32Const or bech32mConst) a valid serial would
+// have settled on. ok reports whether exactly one combination of one or two
+// symbol errors turns code into target; when true, symbols holds the
+// corrected 5-bit values and bitN the number of bits that were flipped to
+// get there.
+func bchRecover(s string, dataStart int, code, target uint) (symbols []byte, bitN int, ok bool) {
+	s = strings.ToLower(s) // charTable has lower-case entries only
+	symbols = make([]byte, len(s)-dataStart)
+	for k := range symbols {
+		symbols[k] = charTable[s[dataStart+k]]
+	}
+
+	fix := bchFindFix(code, target, symbols)
+	if fix == nil {
+		return nil, 0, false
+	}
+	for _, f := range fix {
+		symbols[f.pos] ^= f.delta
+		bitN += bits.OnesCount8(f.delta)
+	}
+	return symbols, bitN, true
+}
+
+// bchFindFix searches for symbol errors that bring code, the checksum
+// residue over symbols, back to target. It returns nil unless exactly one
+// combination of a single symbol error or a pair of symbol errors qualifies,
+// in which case the correction is returned as one or two symbolFix values.
+func bchFindFix(code, target uint, symbols []byte) []symbolFix {
+	n := len(symbols)
+	basis := bchBasis(n)
+
+	type candidate struct {
+		pos   int
+		delta byte
+	}
+	byEffect := make(map[uint][]candidate)
+	for p := 0; p < n; p++ {
+		for delta := uint(1); delta < 32; delta++ {
+			eff := bchEffect(basis, p, delta)
+			byEffect[eff] = append(byEffect[eff], candidate{pos: p, delta: byte(delta)})
+		}
+	}
+
+	var found [][]symbolFix
+	for eff, cands := range byEffect {
+		if code^eff != target {
+			continue
+		}
+		for _, c := range cands {
+			found = append(found, []symbolFix{{c.pos, c.delta}})
+		}
+	}
+	for p1 := 0; p1 < n; p1++ {
+		for delta1 := uint(1); delta1 < 32; delta1++ {
+			eff1 := bchEffect(basis, p1, delta1)
+			want := code ^ target ^ eff1
+			for _, c2 := range byEffect[want] {
+				if c2.pos <= p1 {
+					continue
+				}
+				found = append(found, []symbolFix{{p1, byte(delta1)}, {c2.pos, c2.delta}})
+			}
+		}
+		if len(found) > 1 {
+			return nil
+		}
+	}
+	if len(found) != 1 {
+		return nil
+	}
+	return found[0]
+}
+
+// bchBasis computes, for a run of n BCH(32) data/checksum symbols starting
+// from a zero residue, the effect that setting bit b (0 to 4) alone in the
+// symbol at each position has on the final residue. Because check5Bits XORs
+// its value argument in without otherwise depending on it, the residue is a
+// linear (GF(2)) function of every symbol, so the effect of an arbitrary
+// 5-bit error at a position is the XOR of the relevant bits' entries here.
+func bchBasis(n int) [5][]uint {
+	var basis [5][]uint
+	for b := uint(0); b < 5; b++ {
+		table := make([]uint, n)
+		v := uint(1) << b
+		for p := n - 1; p >= 0; p-- {
+			table[p] = v
+			v = check5Bits(v, 0)
+		}
+		basis[b] = table
+	}
+	return basis
+}
+
+// bchEffect returns the change to the final BCH(32) residue caused by
+// XOR'ing delta into the symbol at position p, as derived from basis.
+func bchEffect(basis [5][]uint, p int, delta uint) uint {
+	var eff uint
+	for b := uint(0); b < 5; b++ {
+		if delta&(1<<b) != 0 {
+			eff ^= basis[b][p]
+		}
+	}
+	return eff
+}
+
+// SegWit address errors.
+var (
+	errSegWitVersion  = errors.New("bech32: segwit version out of range")
+	errSegWitProgram  = errors.New("bech32: segwit program length out of range")
+	errSegWitEncoding = errors.New("bech32: segwit address uses the wrong bech32 variant for its version")
+)
+
+// EncodeSegWit encodes a SegWit witness program as a Bech32 address for
+// version 0, or a Bech32m address (BIP350) for version 1 and up, with hrp
+// for the network-specific human-readable prefix, e.g. "bc" for Bitcoin
+// mainnet or "tb" for its test network.
+func EncodeSegWit(hrp string, version int, program []byte) (string, error) {
+	if version < 0 || version > 16 {
+		return "", errSegWitVersion
+	}
+	if len(program) < 2 || len(program) > 40 {
+		return "", errSegWitProgram
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return "", errSegWitProgram
+	}
+
+	progSymbols, _ := ConvertBits(program, 8, 5, true) // err is impossible: bytes always fit in 8 bits
+	symbols := append([]byte{byte(version)}, progSymbols...)
+
+	constant := uint(bech32Const)
+	if version > 0 {
+		constant = bech32mConst
+	}
+	return formatSymbols(hrp, symbols, constant, 90)
+}
+
+// DecodeSegWit decodes a SegWit address, with hrp for the human-readable
+// prefix. It rejects addresses that use the wrong Bech32/Bech32m variant for
+// their version (per BIP350), and programs with a non-canonical length.
+func DecodeSegWit(s string) (hrp string, version int, program []byte, err error) {
+	label, symbols, enc, err := parseSymbols(s)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(symbols) == 0 {
+		return "", 0, nil, errSegWitVersion
+	}
+
+	version = int(symbols[0])
+	if version > 16 {
+		return "", 0, nil, errSegWitVersion
+	}
+	wantEnc := Bech32
+	if version > 0 {
+		wantEnc = Bech32m
+	}
+	if enc != wantEnc {
+		return "", 0, nil, errSegWitEncoding
+	}
+
+	program, err = ConvertBits(symbols[1:], 5, 8, false)
+	if err != nil || len(program) < 2 || len(program) > 40 {
+		return "", 0, nil, errSegWitProgram
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return "", 0, nil, errSegWitProgram
+	}
+
+	return label, version, program, nil
+}
+
+// formatSymbols builds a Bech32(m) serial directly from 5-bit values. It
+// backs format, once that has regrouped p into symbols, as well as the
+// exported FormatSymbols (constant fixed to bech32Const) and EncodeSegWit
+// (constant selected by witness version).
+func formatSymbols(label string, symbols []byte, constant uint, maxLen int) (string, error) {
+	l := 7 + len(label) + len(symbols)
+	if maxLen != Unlimited && l > maxLen {
+		return "", ErrBig
+	}
+	code, err := labelCheck(label)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.Grow(l)
+	b.WriteString(label)
+	b.WriteByte('1')
+	for _, v := range symbols {
+		code = check5Bits(code, uint(v))
+		b.WriteByte(dictionary[v])
+	}
+	for i := 0; i < 6; i++ {
+		code = check5Bits(code, 0)
+	}
+	code ^= constant
+	b.WriteByte(dictionary[code>>25&31])
+	b.WriteByte(dictionary[code>>20&31])
+	b.WriteByte(dictionary[code>>15&31])
+	b.WriteByte(dictionary[code>>10&31])
+	b.WriteByte(dictionary[code>>5&31])
+	b.WriteByte(dictionary[code>>0&31])
+	return b.String(), nil
+}
+
+// parseSymbols reads the label and the 5-bit data-part values (excluding the
+// trailing checksum) from s, along with the Bech32/Bech32m constant that
+// matched. Unlike ParseSymbols, it auto-detects the variant the same way
+// Parse2 does, but it does not attempt BCH error correction: a checksum
+// mismatch is rejected with ChecksumError(0). DecodeSegWit is its only caller.
+func parseSymbols(s string) (label string, symbols []byte, enc Encoding, err error) {
+	label, all, code, dataStart, checksumStart, err := decode(s)
+	if err != nil {
+		return "", nil, 0, err
+	}
+
+	switch code {
+	case bech32Const:
+		enc = Bech32
+	case bech32mConst:
+		enc = Bech32m
+	default:
+		return "", nil, 0, ChecksumError(0)
+	}
+	return label, all[:checksumStart-dataStart], enc, nil
+}
+
 // See the “Checksum” subsection in BIP173.
 func check5Bits(code uint, v uint) uint {
 	b := code >> 25
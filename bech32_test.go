@@ -2,6 +2,8 @@ package bech32
 
 import (
 	"bytes"
+	"io"
+	"math/rand"
 	"strings"
 	"testing"
 )
@@ -86,6 +88,404 @@ func TestInvalid(t *testing.T) {
 	}
 }
 
+func TestValidM(t *testing.T) {
+	tests := []string{
+		"A1LQFN3A",
+		"a1lqfn3a",
+		"an83characterlonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber1quhv6rg",
+		"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx",
+		"11llllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllllludsr8",
+		"split1checkupstagehandshakeupstreamerranterredcaperredlc445v",
+		"?1v759aa",
+	}
+
+	for _, s := range tests {
+		label, data, padding, err := ParseM(s)
+		if err != nil {
+			t.Errorf("%q got error %s", s, err)
+			continue
+		}
+
+		s2, err := FormatM(label, data, len(data)*8-padding)
+		if err != nil {
+			t.Errorf("%q recoding got error %s", s, err)
+			continue
+		}
+		if lower := strings.ToLower(s); lower != s2 {
+			t.Errorf("%q recoded to %s, want %q", s, s2, lower)
+		}
+
+		if _, _, _, err := Parse(s); err == nil {
+			t.Errorf("%q is Bech32m, yet got no error from the strict Bech32 Parse", s)
+		}
+	}
+}
+
+func TestInvalidM(t *testing.T) {
+	tests := []string{
+		"\x201xj0phk", // HRP character out of range
+		"\x7F1g6xzxy", // HRP character out of range
+		"\x801vctc34", // HRP character out of range
+		"an84characterslonghumanreadablepartthatcontainsthetheexcludedcharactersbioandnumber11d6pts4", // overall max length exceeded
+		"qyrz8wqd2c9m",  // no separator character
+		"1qyrz8wqd2c9m", // empty HRP
+		"y1b0jsk6g",     // invalid data character
+		"lt1igcx5c0",    // invalid data character
+		"in1muywd",      // too short checksum
+		"mm1crxm3i",     // invalid character in checksum
+		"au1s5cgom",     // invalid character in checksum
+		"M1VUXWEZ",      // checksum calculated with uppercase form of HRP
+		"16plkw9",       // empty HRP
+		"1p2gdwpf",      // empty HRP
+	}
+
+	for _, s := range tests {
+		_, _, _, err := ParseM(s)
+		if err == nil {
+			t.Errorf("no error for %q", s)
+		}
+	}
+}
+
+func TestParse2(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Encoding
+	}{
+		{"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw", Bech32},
+		{"abcdef1l7aum6echk45nj3s0wdvt2fg8x9yrzpqzd3ryx", Bech32m},
+	}
+
+	for _, tc := range tests {
+		_, _, _, enc, err := Parse2(tc.s)
+		if err != nil {
+			t.Errorf("Parse2(%q) got error %s", tc.s, err)
+			continue
+		}
+		if enc != tc.want {
+			t.Errorf("Parse2(%q) got %s, want %s", tc.s, enc, tc.want)
+		}
+	}
+}
+
+func TestSegWit(t *testing.T) {
+	tests := []struct {
+		hrp     string
+		version int
+		program []byte
+	}{
+		{"bc", 0, make([]byte, 20)},
+		{"bc", 0, make([]byte, 32)},
+		{"tb", 1, make([]byte, 32)}, // taproot, Bech32m
+		{"bc", 16, make([]byte, 2)}, // shortest program, highest version
+		{"bc", 2, make([]byte, 40)}, // longest program
+	}
+
+	for _, tc := range tests {
+		for i := range tc.program {
+			tc.program[i] = byte(i * 7) // arbitrary, non-zero content
+		}
+
+		s, err := EncodeSegWit(tc.hrp, tc.version, tc.program)
+		if err != nil {
+			t.Errorf("EncodeSegWit(%q, %d, %#x) got error %s", tc.hrp, tc.version, tc.program, err)
+			continue
+		}
+
+		hrp, version, program, err := DecodeSegWit(s)
+		if err != nil {
+			t.Errorf("DecodeSegWit(%q) got error %s", s, err)
+			continue
+		}
+		if hrp != tc.hrp || version != tc.version || !bytes.Equal(program, tc.program) {
+			t.Errorf("DecodeSegWit(%q) got %q, %d, %#x, want %q, %d, %#x",
+				s, hrp, version, program, tc.hrp, tc.version, tc.program)
+		}
+	}
+}
+
+func TestSegWitBIP173Vector(t *testing.T) {
+	const s = "BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4"
+	hrp, version, program, err := DecodeSegWit(s)
+	if err != nil {
+		t.Fatalf("DecodeSegWit(%q) got error %s", s, err)
+	}
+	if hrp != "bc" || version != 0 || len(program) != 20 {
+		t.Errorf("DecodeSegWit(%q) got %q, %d, %#x", s, hrp, version, program)
+	}
+
+	got, err := EncodeSegWit(hrp, version, program)
+	if err != nil {
+		t.Fatalf("EncodeSegWit(%q, %d, %#x) got error %s", hrp, version, program, err)
+	}
+	if want := strings.ToLower(s); got != want {
+		t.Errorf("EncodeSegWit(%q, %d, %#x) got %q, want %q", hrp, version, program, got, want)
+	}
+}
+
+func TestSegWitInvalid(t *testing.T) {
+	if _, err := EncodeSegWit("bc", 17, make([]byte, 20)); err == nil {
+		t.Error("EncodeSegWit with version 17 got no error")
+	}
+	if _, err := EncodeSegWit("bc", 0, make([]byte, 1)); err == nil {
+		t.Error("EncodeSegWit with a 1-byte program got no error")
+	}
+	if _, err := EncodeSegWit("bc", 0, make([]byte, 21)); err == nil {
+		t.Error("EncodeSegWit with a non-canonical v0 program length got no error")
+	}
+	if _, err := EncodeSegWit("bc", 0, make([]byte, 41)); err == nil {
+		t.Error("EncodeSegWit with a 41-byte program got no error")
+	}
+
+	valid, err := EncodeSegWit("bc", 0, make([]byte, 20))
+	if err != nil {
+		t.Fatalf("EncodeSegWit got error %s", err)
+	}
+	mixedCase := valid[:len(valid)/2] + strings.ToUpper(valid[len(valid)/2:])
+	if _, _, _, err := DecodeSegWit(mixedCase); err == nil {
+		t.Errorf("DecodeSegWit(%q), with mixed upper/lower case, got no error", mixedCase)
+	}
+
+	// a v0 program checksummed as Bech32m uses the wrong variant
+	progSymbols, err := ConvertBits(make([]byte, 20), 8, 5, true)
+	if err != nil {
+		t.Fatalf("ConvertBits got error %s", err)
+	}
+	wrongVariant, err := formatSymbols("bc", append([]byte{0}, progSymbols...), bech32mConst, 90)
+	if err != nil {
+		t.Fatalf("formatSymbols got error %s", err)
+	}
+	if _, _, _, err := DecodeSegWit(wrongVariant); err != errSegWitEncoding {
+		t.Errorf("DecodeSegWit(%q), which is Bech32m for a v0 program, got error %v, want errSegWitEncoding", wrongVariant, err)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	valid := []string{
+		"a12uel5l",
+		"abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw",
+		"split1checkupstagehandshakeupstreamerranterredcaperred2y9e3w",
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, s := range valid {
+		wantLabel, wantPayload, wantPadding, err := Parse(s)
+		if err != nil {
+			t.Fatalf("Parse(%q) got error %s", s, err)
+		}
+
+		for errN := 1; errN <= 2; errN++ {
+			mutated := mutateSymbols(s, errN, rng)
+
+			label, payload, padding, err := Parse(mutated)
+			switch e := err.(type) {
+			case nil:
+				t.Errorf("Parse(%q), which has %d corrupted symbol(s) from %q, got no error", mutated, errN, s)
+
+			case ChecksumError:
+				if e == 0 {
+					t.Errorf("Parse(%q), which has %d corrupted symbol(s) from %q, failed to recover the checksum", mutated, errN, s)
+					continue
+				}
+				if label != wantLabel || !bytes.Equal(payload, wantPayload) || padding != wantPadding {
+					t.Errorf("Parse(%q), which has %d corrupted symbol(s) from %q, recovered %q, %#x, %d, want %q, %#x, %d",
+						mutated, errN, s, label, payload, padding, wantLabel, wantPayload, wantPadding)
+				}
+
+			default:
+				t.Errorf("Parse(%q), which has %d corrupted symbol(s) from %q, got error %s, want a ChecksumError", mutated, errN, s, err)
+			}
+		}
+	}
+}
+
+// mutateSymbol flips the data-part symbol of s at pos (0-based, counting from
+// the character right after the label separator) by XOR-ing delta into its
+// 5-bit value.
+func mutateSymbol(s string, pos int, delta byte) string {
+	i := strings.LastIndexByte(s, '1')
+	b := []byte(s)
+	j := i + 1 + pos
+	b[j] = dictionary[(charTable[b[j]]^delta)&31]
+	return string(b)
+}
+
+// mutateSymbols flips n distinct, randomly picked data-part symbols of s to
+// a different value from the dictionary.
+func mutateSymbols(s string, n int, rng *rand.Rand) string {
+	i := strings.LastIndexByte(s, '1')
+	b := []byte(s)
+	for _, p := range rng.Perm(len(b) - i - 1)[:n] {
+		j := i + 1 + p
+		v := charTable[b[j]]
+		b[j] = dictionary[(v+byte(1+rng.Intn(31)))%32]
+	}
+	return string(b)
+}
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder("test", &buf)
+	if _, err := enc.Write(make([]byte, 20)); err != nil {
+		t.Fatalf("Write got error %s", err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close got error %s", err)
+	}
+
+	const want = "test1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqql6aptf"
+	if got := buf.String(); got != want {
+		t.Errorf("got serial %q, want %q", got, want)
+	}
+
+	if _, err := enc.Write([]byte{0}); err != errEncoderClosed {
+		t.Errorf("Write after Close got error %v, want errEncoderClosed", err)
+	}
+	if err := enc.Close(); err != nil {
+		t.Errorf("second Close got error %v, want nil", err)
+	}
+}
+
+func TestEncoderChunked(t *testing.T) {
+	payload := make([]byte, 20)
+	for i := range payload {
+		payload[i] = byte(i * 13)
+	}
+	want, err := Format("test", payload, len(payload)*8)
+	if err != nil {
+		t.Fatalf("Format got error %s", err)
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder("test", &buf)
+	for _, c := range payload {
+		if _, err := enc.Write([]byte{c}); err != nil {
+			t.Fatalf("Write got error %s", err)
+		}
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatalf("Close got error %s", err)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("byte-at-a-time encode got %q, want %q", got, want)
+	}
+}
+
+func TestEncoderMaxLen(t *testing.T) {
+	var buf bytes.Buffer
+	f := Formatter{MaxLen: 10}
+	enc := f.NewEncoder("test", &buf)
+	if _, err := enc.Write(make([]byte, 20)); err != ErrBig {
+		t.Errorf("Write past MaxLen got error %v, want ErrBig", err)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	const serial = "test1qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqql6aptf"
+	label, padding, r, err := NewDecoder(strings.NewReader(serial))
+	if err != nil {
+		t.Fatalf("NewDecoder(%q) got error %s", serial, err)
+	}
+	if label != "test" {
+		t.Errorf("NewDecoder(%q) got label %q, want \"test\"", serial, label)
+	}
+	if padding != 0 {
+		t.Errorf("NewDecoder(%q) got padding %d, want 0", serial, padding)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read from decoded payload got error %s", err)
+	}
+	if !bytes.Equal(got, make([]byte, 20)) {
+		t.Errorf("NewDecoder(%q) got payload %#x, want 20 zero bytes", serial, got)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close got error %s", err)
+	}
+}
+
+func TestDecoderChecksumError(t *testing.T) {
+	const serial = "a12uel5l"
+	mutated := mutateSymbol(serial, 0, 1)
+	label, _, r, err := NewDecoder(strings.NewReader(mutated))
+	if err != nil {
+		t.Fatalf("NewDecoder(%q) got error %s, want nil; checksum errors are deferred to Read", mutated, err)
+	}
+
+	payload, err := io.ReadAll(r)
+	e, ok := err.(ChecksumError)
+	if !ok {
+		t.Fatalf("read from decoded payload got error %v, want a ChecksumError", err)
+	}
+	if e == 0 {
+		t.Fatalf("read from decoded payload of %q failed to recover the checksum", mutated)
+	}
+	if label != "a" {
+		t.Errorf("NewDecoder(%q) got label %q, want \"a\" from the recovered checksum", mutated, label)
+	}
+	if !bytes.Equal(payload, make([]byte, 0)) {
+		t.Errorf("NewDecoder(%q) got payload %#x, want none", mutated, payload)
+	}
+}
+
+func TestConvertBits(t *testing.T) {
+	data := []byte{0xff, 0x00, 0xf8}
+	symbols, err := ConvertBits(data, 8, 5, true)
+	if err != nil {
+		t.Fatalf("ConvertBits(%#x, 8, 5, true) got error %s", data, err)
+	}
+	back, err := ConvertBits(symbols, 5, 8, false)
+	if err != nil {
+		t.Fatalf("ConvertBits(%v, 5, 8, false) got error %s", symbols, err)
+	}
+	if !bytes.Equal(back, data) {
+		t.Errorf("round trip through 5-bit symbols got %#x, want %#x", back, data)
+	}
+
+	// 0xff, 0x00, 0xf8 is 24 bits, which is not a whole number of 5-bit
+	// groups; its trailing bits are non-zero, so pad true zero-pads them
+	// into one more symbol, while pad false rejects the input outright.
+	if _, err := ConvertBits(data, 8, 5, false); err == nil {
+		t.Error("ConvertBits with pad false on non-whole-group input got no error")
+	}
+
+	if _, err := ConvertBits([]byte{32}, 5, 8, true); err == nil {
+		t.Error("ConvertBits with a value exceeding fromBits got no error")
+	}
+	if _, err := ConvertBits(data, 0, 5, true); err == nil {
+		t.Error("ConvertBits with fromBits 0 got no error")
+	}
+	if _, err := ConvertBits(data, 8, 9, true); err == nil {
+		t.Error("ConvertBits with toBits 9 got no error")
+	}
+}
+
+func TestFormatSymbolsParseSymbols(t *testing.T) {
+	symbols := []byte{0, 31, 15, 1, 0}
+	s, err := FormatSymbols("test", symbols)
+	if err != nil {
+		t.Fatalf("FormatSymbols(%q, %v) got error %s", "test", symbols, err)
+	}
+
+	label, got, err := ParseSymbols(s)
+	if err != nil {
+		t.Fatalf("ParseSymbols(%q) got error %s", s, err)
+	}
+	if label != "test" {
+		t.Errorf("ParseSymbols(%q) got label %q, want \"test\"", s, label)
+	}
+	if !bytes.Equal(got, symbols) {
+		t.Errorf("ParseSymbols(%q) got symbols %v, want %v", s, got, symbols)
+	}
+
+	last := s[len(s)-1]
+	replacement := dictionary[(charTable[last]+1)%32]
+	corrupted := s[:len(s)-1] + string(replacement)
+	if _, _, err := ParseSymbols(corrupted); err == nil {
+		t.Errorf("ParseSymbols(%q), a corrupted serial, got no error", corrupted)
+	}
+}
+
 func BenchmarkParse(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		_, _, _, err := Parse("abcdef1qpzry9x8gf2tvdw0s3jn54khce6mua7lmqqqxw")